@@ -2,86 +2,163 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"math/rand"
 	"net"
-	"net/http"
-	"strconv"
+	"sync"
 	"time"
-
-	"github.com/go-redis/redis/v8"
 )
 
-func ipToKey(ip net.IP) string {
-	return fmt.Sprintf("aws-fail2ban-%s", ip.String())
+type ServiceJailer struct {
+	ipset *IpSet
+	store StateStore
+	bus   EventBus
+	geoip GeoIPResolver
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// managerToken identifies this process to ManagerLock, so it can only
+	// ever refresh or release the lease it took out itself.
+	managerToken string
+
+	// Token-bucket rate limiter parameters used by AddRequest, ref: SetRateLimit
+	packetsPerSecond int64
+	packetsBurstable int64
+	tokenBucketTTL   time.Duration
 }
 
-func keyToIp(key string) net.IP {
-	// Possibly nil but should never happen
-	return net.ParseIP(key[len("aws-fail2ban-"):])
+// NewServiceJailer builds a ServiceJailer from a state store connection
+// string, e.g. "redis://host:port", "redis+sentinel://host1,host2/master",
+// "redis+cluster://host1,host2", "memory://" or "leveldb:///path". See
+// NewStateStore for the full set of supported schemes. ctx bounds the
+// jailer's background manageState loop and event subscription; canceling it
+// stops both but, unlike Close, leaves the state store open.
+func NewServiceJailer(ctx context.Context, ipsetName, conn string) (*ServiceJailer, error) {
+	store, err := NewStateStore(conn)
+	if err != nil {
+		return nil, err
+	}
+	return NewServiceJailerWithStore(ctx, ipsetName, store)
 }
 
-type ServiceJailer struct {
-	ipset       *IpSet
-
-	// Concurrency-safe, ref: https://github.com/go-redis/redis/blob/master/redis.go
-	redisClient *redis.Client
-
-	quitChan    chan bool
+// NewServiceJailerSentinel connects via a sentinel group, enabling automatic
+// failover to a new master without reconfiguring every container.
+func NewServiceJailerSentinel(ctx context.Context, ipsetName, masterName string, sentinelAddrs []string) (*ServiceJailer, error) {
+	redisClient, err := newSentinelRedisClient(masterName, sentinelAddrs)
+	if err != nil {
+		return nil, err
+	}
+	return NewServiceJailerWithStore(ctx, ipsetName, newRedisStateStore(redisClient))
 }
 
-func NewServiceJailer(ipsetName, redisAddr string) (*ServiceJailer, error) {
-	ipset, err := NewIpSet(ipsetName)
+// NewServiceJailerCluster connects to a Redis Cluster, letting state scale
+// horizontally across masters instead of a single node.
+func NewServiceJailerCluster(ctx context.Context, ipsetName string, addrs []string) (*ServiceJailer, error) {
+	redisClient, err := newClusterRedisClient(addrs)
 	if err != nil {
 		return nil, err
 	}
+	return NewServiceJailerWithStore(ctx, ipsetName, newRedisStateStore(redisClient))
+}
 
-	redisClient := redis.NewClient(&redis.Options{Addr: redisAddr})
-	_, err = redisClient.Ping(context.Background()).Result()
+// NewServiceJailerWithStore builds a ServiceJailer from an already
+// constructed StateStore, for callers that want to assemble or mock one
+// directly rather than going through a connection string.
+func NewServiceJailerWithStore(ctx context.Context, ipsetName string, store StateStore) (*ServiceJailer, error) {
+	ipset, err := NewIpSet(ipsetName)
 	if err != nil {
 		return nil, err
 	}
 
+	bus, ok := store.(EventBus)
+	if !ok {
+		bus = noopEventBus{}
+	}
+
 	jailer := &ServiceJailer{
-		      ipset: ipset,
-		redisClient: redisClient,
-		   quitChan: make(chan bool),
+		ipset: ipset,
+		store: store,
+		bus:   bus,
+
+		managerToken: newNodeID(),
+
+		packetsPerSecond: defaultPacketsPerSecond,
+		packetsBurstable: defaultPacketsBurstable,
+		tokenBucketTTL:   defaultTokenBucketTTL,
 	}
+	jailer.ctx, jailer.cancel = context.WithCancel(ctx)
 
-	// Sleep a random amount of time should multiple containers be started simultaneously
-	rand.Seed(time.Now().UnixNano())
-	time.Sleep(time.Duration(rand.Intn(60)) * time.Second)
+	// Apply peer-originated ban/unban events directly to the local ipset;
+	// this must not go through Ban/Unban, which would re-publish the event
+	// and loop it around the fleet forever.
+	onPeerBan := func(ip net.IP, until time.Time) {
+		if err := jailer.ipset.Add(ip); err != nil {
+			ErrorLog(err.Error())
+		}
+	}
+	onPeerUnban := func(ip net.IP) {
+		if err := jailer.ipset.Del(ip); err != nil {
+			ErrorLog(err.Error())
+		}
+	}
+	currentlyBanned := func() []net.IP {
+		ips, _, err := jailer.ipset.Get()
+		if err != nil {
+			ErrorLog(err.Error())
+			return nil
+		}
+		return ips
+	}
 
 	// Ensure ip set contents are being managed
-	if ips, _, err := ipset.Get(); err != nil {
+	ips, _, err := ipset.Get()
+	if err != nil {
+		jailer.cancel()
+		if closeErr := store.Close(); closeErr != nil {
+			ErrorLog(closeErr.Error())
+		}
 		return nil, err
-	} else {
-		for _, ip := range ips {
-			llen, err := redisClient.LLen(context.Background(), ipToKey(ip)).Result()
-			if err != nil {
+	}
+	for _, ip := range ips {
+		infractions, err := store.List(jailer.ctx, ip)
+		if err != nil {
+			ErrorLog(err.Error())
+			continue
+		}
+
+		for i := int64(len(infractions)); i < MaxRetry; i++ {
+			if err := jailer.AddInfraction(jailer.ctx, ip); err != nil {
 				ErrorLog(err.Error())
-				continue
 			}
+		}
+	}
 
-			for i:=llen; i<MaxRetry; i++ {
-				if err := jailer.AddInfraction(ip); err != nil {
-					ErrorLog(err.Error())
-				}
-			}
+	go func() {
+		if err := bus.Subscribe(jailer.ctx, onPeerBan, onPeerUnban, currentlyBanned); err != nil {
+			ErrorLog(err.Error())
 		}
+	}()
+
+	// Ask peers to republish their current bans so this container doesn't
+	// have to wait for its own manageState scan to converge on them.
+	if err := bus.RequestSync(jailer.ctx, onPeerBan); err != nil {
+		ErrorLog(err.Error())
 	}
 
 	go func() {
-		// Use random periods in a crude attempt to avoid overlap with other containers
-		// TODO Ideally want something based on FindTime and BanTime
-		period := time.Duration(rand.Intn(60) + 60) * time.Second
+		// There's no point scanning more often than the window an infraction
+		// can still count within, and no point taking longer than BanTime to
+		// notice one has expired.
+		period := FindTime * time.Second
+		if BanTime < FindTime {
+			period = BanTime * time.Second
+		}
 
 		for {
 			select {
-				case <-jailer.quitChan:
-					break
-				case <-time.After(period):
-					jailer.manageState()
+			case <-jailer.ctx.Done():
+				return
+			case <-time.After(period):
+				jailer.runManageStateIfLeader(jailer.ctx)
 			}
 		}
 	}()
@@ -89,43 +166,32 @@ func NewServiceJailer(ipsetName, redisAddr string) (*ServiceJailer, error) {
 	return jailer, nil
 }
 
-func (j ServiceJailer) Close() error {
-	j.quitChan <- true
+// Close cancels the jailer's background manageState loop and closes its
+// state store. Canceling the context (rather than signaling over a channel)
+// means this can't deadlock even if the loop has already exited on its own.
+// ctx bounds the store close itself, since backends like levelDBStateStore
+// can block on disk I/O and StateStore.Close doesn't take one of its own.
+func (j ServiceJailer) Close(ctx context.Context) error {
+	j.cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- j.store.Close() }()
 
-	if err := j.redisClient.Close(); err != nil {
+	select {
+	case err := <-done:
 		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-
-	return nil
 }
 
-func (j ServiceJailer) manageState() {
-	ctx := context.Background()
-
-	var cursor uint64 = 0
-	var count int64 = 100
-
+func (j ServiceJailer) manageState(ctx context.Context) {
 	keysEvaluated := 0
-	scanIterations := 0
 	ipsDeleted := 0
 	ipsAffected := 0
 	infractionsDeleted := 0
 	ipsUnbanned := 0
-
-	listToInfractions := func(redisList []string) []time.Time {
-		var rv []time.Time
-		for _, s := range redisList {
-			unixtime, err := strconv.ParseInt(s, 10, 64)
-			if err != nil {
-				ErrorLog("unable to parse time %s", s)
-				continue
-			}
-			t := time.Unix(unixtime, 0)
-
-			rv = append(rv, t)
-		}
-		return rv
-	}
+	var mu sync.Mutex // Scan may invoke the callback concurrently across shards
 
 	bannedUntil := func(infractions []time.Time) time.Time {
 		if len(infractions) < MaxRetry {
@@ -136,84 +202,70 @@ func (j ServiceJailer) manageState() {
 	}
 
 	unban := func(ip net.IP) {
+		mu.Lock()
 		ipsUnbanned++
+		mu.Unlock()
 
 		InfoLog("%s is unbanned", ip.String())
-		if err := j.Unban(ip); err != nil {
+		if err := j.Unban(ctx, ip); err != nil {
 			ErrorLog(err.Error())
 		}
 	}
 
 	start := time.Now()
 
-	for {
-		keys, retCursor, err := j.redisClient.Scan(ctx, cursor, "aws-fail2ban-*", count).Result()
-		if err != nil {
-			ErrorLog(err.Error())
+	err := j.store.Scan(ctx, func(ip net.IP, infractions []time.Time) error {
+		limit := len(infractions)
+
+		endtime := bannedUntil(infractions)
+		if !endtime.IsZero() && time.Now().Before(endtime) {
+			limit = len(infractions) - MaxRetry
+			DebugLog("%s banned until %s", ip.String(), endtime.Format("2006-01-02T15:04:05"))
 		}
 
-		for _, key := range keys {
-			ip := keyToIp(key)
-			if ip == nil {
-				ErrorLog("unable to parse ip from %s", key)
-				continue
+		var i int
+		for i = 0; i < limit; i++ {
+			if time.Now().Sub(infractions[i]).Seconds() < FindTime {
+				break
 			}
+		}
+
+		mu.Lock()
+		keysEvaluated++
+		mu.Unlock()
 
-			redisList, err := j.redisClient.LRange(ctx, key, 0, -1).Result()
-			if err != nil {
+		if i == len(infractions) {
+			if len(infractions) >= MaxRetry {
+				unban(ip)
+			}
+
+			if err := j.store.Delete(ctx, ip); err != nil {
 				ErrorLog(err.Error())
-				continue
 			}
 
-			infractions := listToInfractions(redisList)
-			limit := len(infractions)
+			mu.Lock()
+			ipsDeleted++
+			mu.Unlock()
 
-			endtime := bannedUntil(infractions)
-			if !endtime.IsZero() && time.Now().Before(endtime) {
-				limit = len(infractions) - MaxRetry
-				DebugLog("%s banned until %s", ip.String(), endtime.Format("2006-01-02T15:04:05"))
+		} else if i > 0 {
+			if len(infractions) >= MaxRetry && len(infractions)-i < MaxRetry {
+				unban(ip)
 			}
 
-			var i int
-			for i = 0; i < limit; i++ {
-				if time.Now().Sub(infractions[i]).Seconds() < FindTime {
-					break
-				}
-			}
-			if i == len(infractions) {
-				if len(infractions) >= MaxRetry {
-					unban(ip)
-				}
-
-				if _, err := j.redisClient.Del(ctx, key).Result(); err != nil {
-					ErrorLog(err.Error())
-				}
-				ipsDeleted++
-
-			} else if i > 0 {
-				if len(infractions) >= MaxRetry && len(infractions)-i < MaxRetry {
-					unban(ip)
-				}
-
-				if _, err := j.redisClient.LTrim(ctx, key, int64(i), -1).Result(); err != nil {
-					ErrorLog(err.Error())
-				}
-				ipsAffected++
-				infractionsDeleted += i
+			if err := j.store.Trim(ctx, ip, int64(i)); err != nil {
+				ErrorLog(err.Error())
 			}
-		}
-
-		keysEvaluated += len(keys)
-		scanIterations++
 
-		if retCursor == 0 {
-			break
+			mu.Lock()
+			ipsAffected++
+			infractionsDeleted += i
+			mu.Unlock()
 		}
-		cursor = retCursor
 
-		if count < 1000 {
-			count *= 2
-		}
+		return nil
+	})
+	if err != nil {
+		ErrorLog(err.Error())
 	}
 
 	suffix := func(v int) string {
@@ -224,8 +276,8 @@ func (j ServiceJailer) manageState() {
 		}
 	}
 
-	InfoLog("manageState: %d key%s evaluated in %d scan iteration%s / %s",
-	        keysEvaluated, suffix(keysEvaluated), scanIterations, suffix(scanIterations),
+	InfoLog("manageState: %d key%s evaluated / %s",
+		keysEvaluated, suffix(keysEvaluated),
 		time.Since(start).Round(time.Millisecond).String())
 
 	if ipsUnbanned > 0 {
@@ -236,77 +288,63 @@ func (j ServiceJailer) manageState() {
 	}
 	if ipsAffected > 0 {
 		InfoLog("manageState: %d infractions%s deleted from %d ip%s",
-		        infractionsDeleted, suffix(infractionsDeleted), ipsAffected, suffix(ipsAffected))
+			infractionsDeleted, suffix(infractionsDeleted), ipsAffected, suffix(ipsAffected))
 	}
 }
 
-func (j ServiceJailer) AddInfraction(ip net.IP) error {
-	ctx := context.Background()
-
+func (j ServiceJailer) AddInfraction(ctx context.Context, ip net.IP) error {
 	now := time.Now()
-	llen, err := j.redisClient.RPush(ctx, ipToKey(ip), now.Unix()).Result()
+	count, err := j.store.Append(ctx, ip, now)
 	if err != nil {
 		return err
 	}
 
 	DebugLog("%s infraction at %s", ip.String(), now.Format("2006-01-02T15:04:05"))
 
-	if llen >= MaxRetry {
-		InfoLog("%s banned due to %d infractions", ip.String(), llen)
-		if err := j.Ban(ip); err != nil {
+	if count >= MaxRetry {
+		InfoLog("%s banned due to %d infractions", ip.String(), count)
+		if err := j.Ban(ctx, ip); err != nil {
 			return err
 		}
 
-		if llen > MaxRetry {
-			if _, err := j.redisClient.LTrim(ctx, ipToKey(ip), llen-MaxRetry, -1).Result(); err != nil {
+		if count > MaxRetry {
+			if err := j.store.Trim(ctx, ip, count-MaxRetry); err != nil {
 				return err
 			}
 		}
 	}
 
-	if _, err := j.redisClient.Expire(ctx, ipToKey(ip), 2 * BanTime * time.Second).Result(); err != nil {
+	if err := j.store.Expire(ctx, ip, 2*BanTime*time.Second); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (j ServiceJailer) Ban(ip net.IP) error {
+func (j ServiceJailer) Ban(ctx context.Context, ip net.IP) error {
 	go func() {
 		if err := j.ipset.Add(ip); err != nil {
 			ErrorLog(err.Error())
 		}
 	}()
+
+	if err := j.bus.PublishBan(ctx, ip, time.Now().Add(BanTime*time.Second)); err != nil {
+		ErrorLog(err.Error())
+	}
+
 	return nil
 }
 
-func (j ServiceJailer) Unban(ip net.IP) error {
+func (j ServiceJailer) Unban(ctx context.Context, ip net.IP) error {
 	go func() {
 		if err := j.ipset.Del(ip); err != nil {
 			ErrorLog(err.Error())
 		}
 	}()
-	return nil
-}
 
-func (j ServiceJailer) WriteState(w *http.ResponseWriter) error {
-	var err error = nil
-	write := func(s string) {
-		if err != nil {
-			return
-		}
-
-		_, err = (*w).Write([]byte(s))
-		if err != nil {
-			ErrorLog(err.Error())
-		}
+	if err := j.bus.PublishUnban(ctx, ip); err != nil {
+		ErrorLog(err.Error())
 	}
 
-	write("<html><body>\n")
-	write("not implemented, instead refer to:<br/>\n")
-	write("<tt>redis-cli -h &lt;ip&gt; -p &lt;port&gt; --scan --pattern &lt;prefix&gt;-*</tt>\n")
-	write("</body></html>\n")
-
-	return err
+	return nil
 }
-
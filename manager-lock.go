@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// managerLockTTL is how long a manageState leader's lease lasts before
+// another container is free to take over, should the leader die mid-scan.
+const managerLockTTL = 30 * time.Second
+
+// ManagerLock elects a single leader across containers to run manageState,
+// so every container doesn't redundantly scan the same keyspace and race on
+// Trim/Delete. Only backends shared across containers need real mutual
+// exclusion; single-process backends can always acquire since there are no
+// peers to race with.
+type ManagerLock interface {
+	// TryAcquire attempts to become the manageState leader for ttl, using
+	// token to identify this process so only it can refresh or release the
+	// lease it took out. It returns false if another node currently holds it.
+	TryAcquire(ctx context.Context, token string, ttl time.Duration) (bool, error)
+
+	// Refresh extends the lease if this process still holds it, and is a
+	// no-op otherwise.
+	Refresh(ctx context.Context, token string, ttl time.Duration) error
+
+	// Release gives up the lease if this process still holds it.
+	Release(ctx context.Context, token string) error
+}
+
+// runManageStateIfLeader acquires the manageState lease (where the backend
+// supports one) before scanning, refreshing it periodically for the
+// duration of the scan, and releasing it once done. Backends that don't
+// implement ManagerLock have no peers to coordinate with, so the scan always
+// runs.
+func (j ServiceJailer) runManageStateIfLeader(ctx context.Context) {
+	locker, ok := j.store.(ManagerLock)
+	if !ok {
+		j.manageState(ctx)
+		return
+	}
+
+	acquired, err := locker.TryAcquire(ctx, j.managerToken, managerLockTTL)
+	if err != nil {
+		ErrorLog(err.Error())
+		return
+	}
+	if !acquired {
+		return
+	}
+	defer func() {
+		if err := locker.Release(ctx, j.managerToken); err != nil {
+			ErrorLog(err.Error())
+		}
+	}()
+
+	refreshCtx, stopRefresh := context.WithCancel(ctx)
+	defer stopRefresh()
+
+	go func() {
+		ticker := time.NewTicker(managerLockTTL / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-refreshCtx.Done():
+				return
+			case <-ticker.C:
+				if err := locker.Refresh(ctx, j.managerToken, managerLockTTL); err != nil {
+					ErrorLog(err.Error())
+				}
+			}
+		}
+	}()
+
+	j.manageState(ctx)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// fakeLockRedisClient implements just enough of RedisClient to drive
+// redisStateStore's TryAcquire/Refresh/Release against the real
+// managerLockRefreshScript/managerLockReleaseScript guards, without a live
+// Redis server: Eval interprets the two scripts the same way Redis would
+// run them, since they're the only ones exercised here.
+type fakeLockRedisClient struct {
+	mu    sync.Mutex
+	value string
+}
+
+func (f *fakeLockRedisClient) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.value != "" {
+		return redis.NewBoolResult(false, nil)
+	}
+	f.value = fmt.Sprint(value)
+	return redis.NewBoolResult(true, nil)
+}
+
+func (f *fakeLockRedisClient) Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	token := fmt.Sprint(args[0])
+	if f.value != token {
+		return redis.NewCmdResult(int64(0), nil)
+	}
+
+	switch script {
+	case managerLockRefreshScript:
+		return redis.NewCmdResult(int64(1), nil)
+	case managerLockReleaseScript:
+		f.value = ""
+		return redis.NewCmdResult(int64(1), nil)
+	default:
+		return redis.NewCmdResult(nil, fmt.Errorf("fakeLockRedisClient: unsupported script"))
+	}
+}
+
+func (f *fakeLockRedisClient) Ping(ctx context.Context) *redis.StatusCmd {
+	return redis.NewStatusResult("PONG", nil)
+}
+
+func (f *fakeLockRedisClient) RPush(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	return redis.NewIntResult(0, fmt.Errorf("fakeLockRedisClient: not implemented"))
+}
+
+func (f *fakeLockRedisClient) LTrim(ctx context.Context, key string, start, stop int64) *redis.StatusCmd {
+	return redis.NewStatusResult("", fmt.Errorf("fakeLockRedisClient: not implemented"))
+}
+
+func (f *fakeLockRedisClient) LRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd {
+	return redis.NewStringSliceResult(nil, fmt.Errorf("fakeLockRedisClient: not implemented"))
+}
+
+func (f *fakeLockRedisClient) Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd {
+	return redis.NewScanCmdResult(nil, 0, fmt.Errorf("fakeLockRedisClient: not implemented"))
+}
+
+func (f *fakeLockRedisClient) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	return redis.NewIntResult(0, fmt.Errorf("fakeLockRedisClient: not implemented"))
+}
+
+func (f *fakeLockRedisClient) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	return redis.NewBoolResult(false, fmt.Errorf("fakeLockRedisClient: not implemented"))
+}
+
+func (f *fakeLockRedisClient) Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd {
+	return redis.NewIntResult(0, fmt.Errorf("fakeLockRedisClient: not implemented"))
+}
+
+func (f *fakeLockRedisClient) Subscribe(ctx context.Context, channels ...string) *redis.PubSub {
+	return nil
+}
+
+func (f *fakeLockRedisClient) Close() error {
+	return nil
+}
+
+// TestManagerLockGuardsAgainstOtherTokens proves a lease holder's token is
+// the only one that can refresh or release its own lease: a second token
+// must neither acquire the held lock nor be able to tamper with it.
+func TestManagerLockGuardsAgainstOtherTokens(t *testing.T) {
+	store := newRedisStateStore(&fakeLockRedisClient{})
+	ctx := context.Background()
+
+	acquired, err := store.TryAcquire(ctx, "token-a", time.Minute)
+	if err != nil {
+		t.Fatalf("TryAcquire(token-a): %v", err)
+	}
+	if !acquired {
+		t.Fatalf("TryAcquire(token-a) should succeed against an unheld lock")
+	}
+
+	if acquired, err := store.TryAcquire(ctx, "token-b", time.Minute); err != nil {
+		t.Fatalf("TryAcquire(token-b): %v", err)
+	} else if acquired {
+		t.Fatalf("TryAcquire(token-b) should fail while token-a holds the lease")
+	}
+
+	if err := store.Refresh(ctx, "token-b", time.Minute); err != nil {
+		t.Fatalf("Refresh(token-b): %v", err)
+	}
+	if err := store.Release(ctx, "token-b"); err != nil {
+		t.Fatalf("Release(token-b): %v", err)
+	}
+
+	// token-b's no-op refresh/release must not have touched token-a's lease.
+	if acquired, err := store.TryAcquire(ctx, "token-c", time.Minute); err != nil {
+		t.Fatalf("TryAcquire(token-c): %v", err)
+	} else if acquired {
+		t.Fatalf("token-a's lease should still be held after token-b's refresh/release")
+	}
+
+	if err := store.Release(ctx, "token-a"); err != nil {
+		t.Fatalf("Release(token-a): %v", err)
+	}
+	if acquired, err := store.TryAcquire(ctx, "token-c", time.Minute); err != nil {
+		t.Fatalf("TryAcquire(token-c): %v", err)
+	} else if !acquired {
+		t.Fatalf("token-c should acquire the lease once token-a releases it")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+// BanEvent is what's published on the Pub/Sub events channel when a ban or
+// unban happens, and what a sync-request reply carries back per IP.
+type BanEvent struct {
+	NodeID string    `json:"node_id"`
+	Op     string    `json:"op"` // "ban" or "unban"
+	IP     string    `json:"ip"`
+	Until  time.Time `json:"until,omitempty"`
+}
+
+// EventBus lets ServiceJailer announce bans/unbans to peer containers and
+// learn about peer-originated ones, so a fleet converges on the current ban
+// list in milliseconds rather than waiting on manageState's periodic scan.
+// Only backends shared across containers (i.e. Redis) implement it;
+// single-process backends use noopEventBus since there are no peers to
+// announce anything to.
+type EventBus interface {
+	PublishBan(ctx context.Context, ip net.IP, until time.Time) error
+	PublishUnban(ctx context.Context, ip net.IP) error
+
+	// Subscribe delivers peer-originated ban/unban events to onBan/onUnban,
+	// and answers peer sync-request broadcasts with every IP returned by
+	// currentlyBanned, until ctx is canceled.
+	Subscribe(ctx context.Context, onBan func(ip net.IP, until time.Time), onUnban func(ip net.IP), currentlyBanned func() []net.IP) error
+
+	// RequestSync asks peers to republish their current bans, delivering
+	// each one to onBan, and returns once a short collection window elapses.
+	// Used once at startup so a newly started container doesn't have to wait
+	// for the next manageState scan to learn about existing bans.
+	RequestSync(ctx context.Context, onBan func(ip net.IP, until time.Time)) error
+}
+
+// noopEventBus backs the single-process StateStore implementations: there's
+// only one node, so there's nothing to announce or sync.
+type noopEventBus struct{}
+
+func (noopEventBus) PublishBan(ctx context.Context, ip net.IP, until time.Time) error { return nil }
+func (noopEventBus) PublishUnban(ctx context.Context, ip net.IP) error                { return nil }
+
+func (noopEventBus) Subscribe(ctx context.Context, onBan func(net.IP, time.Time), onUnban func(net.IP), currentlyBanned func() []net.IP) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (noopEventBus) RequestSync(ctx context.Context, onBan func(net.IP, time.Time)) error {
+	return nil
+}
+
+// newNodeID generates a per-process identifier so a jailer can recognize and
+// skip events it published itself.
+func newNodeID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		ErrorLog(err.Error())
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisClient is the subset of the go-redis API ServiceJailer relies on, so a
+// single node, a sentinel-backed failover group and a cluster can all be used
+// interchangeably.
+type RedisClient interface {
+	Ping(ctx context.Context) *redis.StatusCmd
+	RPush(ctx context.Context, key string, values ...interface{}) *redis.IntCmd
+	LTrim(ctx context.Context, key string, start, stop int64) *redis.StatusCmd
+	LRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
+	Del(ctx context.Context, keys ...string) *redis.IntCmd
+	Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd
+	SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd
+	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+	Close() error
+}
+
+// *redis.Client covers both the single node and sentinel-backed failover
+// cases (NewClient and NewFailoverClient return the same type), and
+// *redis.ClusterClient covers cluster deployments.
+var (
+	_ RedisClient = (*redis.Client)(nil)
+	_ RedisClient = (*redis.ClusterClient)(nil)
+)
+
+func newSingleRedisClient(addr string) (RedisClient, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if _, err := client.Ping(context.Background()).Result(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func newSentinelRedisClient(masterName string, sentinelAddrs []string) (RedisClient, error) {
+	client := redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:    masterName,
+		SentinelAddrs: sentinelAddrs,
+	})
+	if _, err := client.Ping(context.Background()).Result(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func newClusterRedisClient(addrs []string) (RedisClient, error) {
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: addrs})
+	if _, err := client.Ping(context.Background()).Result(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// forEachMaster runs fn once per cluster master, or just once against client
+// when it isn't a cluster deployment. redisStateStore.Scan relies on this
+// since a plain SCAN only ever sees the keys held by the node it's issued
+// against.
+func forEachMaster(ctx context.Context, client RedisClient, fn func(RedisClient) error) error {
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return fn(node)
+		})
+	}
+	return fn(client)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GeoIPResolver looks up the country an IP geolocates to, for display
+// alongside state in WriteState. It's optional: when none is configured the
+// HTML table's Country column is left empty and the JSON omits the field.
+type GeoIPResolver interface {
+	Country(ip net.IP) (string, error)
+}
+
+// SetGeoIPResolver configures WriteState to annotate each IP with its source
+// country.
+func (j *ServiceJailer) SetGeoIPResolver(resolver GeoIPResolver) {
+	j.geoip = resolver
+}
+
+// ipStateRecord is a single row of WriteState's table, and the unit the JSON
+// API hands back.
+type ipStateRecord struct {
+	IP          string     `json:"ip"`
+	Infractions int        `json:"infractions"`
+	FirstSeen   time.Time  `json:"first_seen"`
+	LastSeen    time.Time  `json:"last_seen"`
+	BannedUntil *time.Time `json:"banned_until,omitempty"`
+	Country     string     `json:"country,omitempty"`
+}
+
+// collectState mirrors manageState's bannedUntil calculation, but reads
+// rather than prunes the keyspace.
+func (j ServiceJailer) collectState(ctx context.Context) ([]ipStateRecord, error) {
+	var mu sync.Mutex
+	var records []ipStateRecord
+
+	err := j.store.Scan(ctx, func(ip net.IP, infractions []time.Time) error {
+		if len(infractions) == 0 {
+			return nil
+		}
+
+		rec := ipStateRecord{
+			IP:          ip.String(),
+			Infractions: len(infractions),
+			FirstSeen:   infractions[0],
+			LastSeen:    infractions[len(infractions)-1],
+		}
+
+		if len(infractions) >= MaxRetry {
+			until := infractions[len(infractions)-1].Add(BanTime * time.Second)
+			rec.BannedUntil = &until
+		}
+
+		if j.geoip != nil {
+			country, err := j.geoip.Country(ip)
+			if err != nil {
+				ErrorLog(err.Error())
+			} else {
+				rec.Country = country
+			}
+		}
+
+		mu.Lock()
+		records = append(records, rec)
+		mu.Unlock()
+
+		return nil
+	})
+
+	return records, err
+}
+
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// stateTemplate renders collectState's records as a table the operator can
+// sort by clicking a column header, without pulling in a JS framework for it.
+var stateTemplate = template.Must(template.New("state").Parse(`<html><head><title>aws-fail2ban state</title>
+<style>table { border-collapse: collapse; } th, td { border: 1px solid #ccc; padding: 4px 8px; } th { cursor: pointer; }</style>
+</head><body>
+<table id="state"><thead><tr>
+<th>IP</th><th>Infractions</th><th>First seen</th><th>Last seen</th><th>Banned until</th><th>Country</th>
+</tr></thead><tbody>
+{{range .}}<tr>
+<td><a href="/ips/{{.IP}}">{{.IP}}</a></td>
+<td>{{.Infractions}}</td>
+<td>{{.FirstSeen}}</td>
+<td>{{.LastSeen}}</td>
+<td>{{if .BannedUntil}}{{.BannedUntil}}{{end}}</td>
+<td>{{.Country}}</td>
+</tr>{{end}}
+</tbody></table>
+<script>
+document.querySelectorAll("#state th").forEach(function(th, col) {
+	th.addEventListener("click", function() {
+		var tbody = document.querySelector("#state tbody")
+		var rows = Array.from(tbody.querySelectorAll("tr"))
+		rows.sort(function(a, b) {
+			return a.children[col].innerText.localeCompare(b.children[col].innerText)
+		})
+		rows.forEach(function(row) { tbody.appendChild(row) })
+	})
+})
+</script>
+</body></html>
+`))
+
+// WriteState renders every IP currently tracked, as an HTML table sortable
+// by column, or as JSON when the request's Accept header asks for it.
+func (j ServiceJailer) WriteState(w http.ResponseWriter, r *http.Request) error {
+	records, err := j.collectState(r.Context())
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(records, func(a, b int) bool { return records[a].IP < records[b].IP })
+
+	if acceptsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(records)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	return stateTemplate.Execute(w, records)
+}
+
+// HandleIP serves /ips/{ip} and /ips/{ip}/infractions: GET returns ip's full
+// infraction timeline, DELETE force-unbans it, and POST against the
+// infractions sub-path records one infraction against it.
+func (j ServiceJailer) HandleIP(w http.ResponseWriter, r *http.Request) error {
+	path := strings.TrimPrefix(r.URL.Path, "/ips/")
+	parts := strings.SplitN(path, "/", 2)
+
+	ip := net.ParseIP(parts[0])
+	if ip == nil {
+		http.Error(w, "invalid ip", http.StatusBadRequest)
+		return nil
+	}
+
+	if len(parts) == 2 {
+		if parts[1] != "infractions" || r.Method != http.MethodPost {
+			http.Error(w, "not found", http.StatusNotFound)
+			return nil
+		}
+		return j.handlePostInfraction(w, r, ip)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		return j.handleGetIP(w, r, ip)
+	case http.MethodDelete:
+		return j.handleDeleteIP(w, r, ip)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+}
+
+func (j ServiceJailer) handleGetIP(w http.ResponseWriter, r *http.Request, ip net.IP) error {
+	infractions, err := j.store.List(r.Context(), ip)
+	if err != nil {
+		return err
+	}
+
+	if acceptsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(infractions)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	_, err = w.Write([]byte("<html><body><ul>\n"))
+	for _, t := range infractions {
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte("<li>" + t.Format("2006-01-02T15:04:05") + "</li>\n"))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte("</ul></body></html>\n"))
+	return err
+}
+
+// handleDeleteIP force-unbans ip regardless of its infraction count, for an
+// operator clearing a false positive without waiting on manageState.
+func (j ServiceJailer) handleDeleteIP(w http.ResponseWriter, r *http.Request, ip net.IP) error {
+	ctx := r.Context()
+
+	if err := j.Unban(ctx, ip); err != nil {
+		return err
+	}
+	if err := j.store.Delete(ctx, ip); err != nil {
+		return err
+	}
+
+	InfoLog("%s force-unbanned via HandleIP", ip.String())
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handlePostInfraction lets an operator manually record an infraction against
+// an IP, e.g. one an upstream report flagged. It goes through AddInfraction,
+// so the IP is banned only once its infraction count reaches MaxRetry.
+func (j ServiceJailer) handlePostInfraction(w http.ResponseWriter, r *http.Request, ip net.IP) error {
+	if err := j.AddInfraction(r.Context(), ip); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
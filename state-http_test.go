@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestJailer builds a ServiceJailer backed by an in-memory store and a
+// real ipset, for exercising state-http.go's handlers directly (no
+// NewServiceJailerWithStore, since that also starts background goroutines
+// these tests don't need). Skipped where ipset isn't usable, e.g. CI
+// sandboxes without CAP_NET_ADMIN.
+func newTestJailer(t *testing.T) *ServiceJailer {
+	t.Helper()
+
+	ipset, err := NewIpSet(fmt.Sprintf("fail2ban-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Skipf("skipping: unable to create a test ipset: %v", err)
+	}
+
+	return &ServiceJailer{
+		ipset: ipset,
+		store: newMemoryStateStore(),
+		bus:   noopEventBus{},
+	}
+}
+
+func TestWriteStateContentNegotiation(t *testing.T) {
+	j := newTestJailer(t)
+
+	ip := net.ParseIP("198.51.100.1")
+	if _, err := j.store.Append(context.Background(), ip, time.Unix(1000, 0)); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	t.Run("html", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		if err := j.WriteState(rec, req); err != nil {
+			t.Fatalf("WriteState: %v", err)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "text/html" {
+			t.Fatalf("Content-Type = %q, want text/html", ct)
+		}
+		if body := rec.Body.String(); !strings.Contains(body, ip.String()) {
+			t.Fatalf("html body doesn't mention %s: %s", ip, body)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		if err := j.WriteState(rec, req); err != nil {
+			t.Fatalf("WriteState: %v", err)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("Content-Type = %q, want application/json", ct)
+		}
+
+		var records []ipStateRecord
+		if err := json.Unmarshal(rec.Body.Bytes(), &records); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		if len(records) != 1 || records[0].IP != ip.String() {
+			t.Fatalf("records = %+v, want one record for %s", records, ip)
+		}
+	})
+}
+
+func TestHandleIPInvalidIP(t *testing.T) {
+	j := newTestJailer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/ips/not-an-ip", nil)
+	rec := httptest.NewRecorder()
+	if err := j.HandleIP(rec, req); err != nil {
+		t.Fatalf("HandleIP: %v", err)
+	}
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandleIPDelete(t *testing.T) {
+	j := newTestJailer(t)
+
+	ip := net.ParseIP("198.51.100.2")
+	if _, err := j.store.Append(context.Background(), ip, time.Unix(1000, 0)); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/ips/"+ip.String(), nil)
+	rec := httptest.NewRecorder()
+	if err := j.HandleIP(rec, req); err != nil {
+		t.Fatalf("HandleIP: %v", err)
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	infractions, err := j.store.List(context.Background(), ip)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(infractions) != 0 {
+		t.Fatalf("infractions after DELETE = %v, want none", infractions)
+	}
+}
+
+func TestHandleIPPostInfraction(t *testing.T) {
+	j := newTestJailer(t)
+
+	ip := net.ParseIP("198.51.100.3")
+	req := httptest.NewRequest(http.MethodPost, "/ips/"+ip.String()+"/infractions", nil)
+	rec := httptest.NewRecorder()
+	if err := j.HandleIP(rec, req); err != nil {
+		t.Fatalf("HandleIP: %v", err)
+	}
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusCreated)
+	}
+
+	infractions, err := j.store.List(context.Background(), ip)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(infractions) != 1 {
+		t.Fatalf("infractions after POST = %v, want exactly one", infractions)
+	}
+}
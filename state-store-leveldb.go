@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	levelDBInfractionPrefix = "infraction:"
+	levelDBBucketPrefix     = "bucket:"
+)
+
+// levelDBStateStore is an embedded, on-disk StateStore for single-node
+// deployments that want infraction state to survive a restart without
+// standing up Redis.
+type levelDBStateStore struct {
+	db *leveldb.DB
+	mu sync.Mutex // guards the read-modify-write of bucket state
+}
+
+func newLevelDBStateStore(path string) (*levelDBStateStore, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &levelDBStateStore{db: db}, nil
+}
+
+func infractionKey(ip net.IP) []byte {
+	return []byte(levelDBInfractionPrefix + ip.String())
+}
+
+func bucketStateKey(ip net.IP) []byte {
+	return []byte(levelDBBucketPrefix + ip.String())
+}
+
+func (s *levelDBStateStore) load(ip net.IP) ([]time.Time, error) {
+	data, err := s.db.Get(infractionKey(ip), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var unixTimes []int64
+	if err := json.Unmarshal(data, &unixTimes); err != nil {
+		return nil, err
+	}
+
+	rv := make([]time.Time, len(unixTimes))
+	for i, t := range unixTimes {
+		rv[i] = time.Unix(t, 0)
+	}
+	return rv, nil
+}
+
+func (s *levelDBStateStore) save(ip net.IP, infractions []time.Time) error {
+	if len(infractions) == 0 {
+		return s.db.Delete(infractionKey(ip), nil)
+	}
+
+	unixTimes := make([]int64, len(infractions))
+	for i, t := range infractions {
+		unixTimes[i] = t.Unix()
+	}
+
+	data, err := json.Marshal(unixTimes)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(infractionKey(ip), data, nil)
+}
+
+func (s *levelDBStateStore) Append(ctx context.Context, ip net.IP, ts time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infractions, err := s.load(ip)
+	if err != nil {
+		return 0, err
+	}
+	infractions = append(infractions, ts)
+
+	if err := s.save(ip, infractions); err != nil {
+		return 0, err
+	}
+	return int64(len(infractions)), nil
+}
+
+func (s *levelDBStateStore) List(ctx context.Context, ip net.IP) ([]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(ip)
+}
+
+func (s *levelDBStateStore) Trim(ctx context.Context, ip net.IP, from int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infractions, err := s.load(ip)
+	if err != nil {
+		return err
+	}
+	if from >= int64(len(infractions)) {
+		return s.db.Delete(infractionKey(ip), nil)
+	}
+	return s.save(ip, infractions[from:])
+}
+
+func (s *levelDBStateStore) Delete(ctx context.Context, ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.Delete(infractionKey(ip), nil)
+}
+
+func (s *levelDBStateStore) Expire(ctx context.Context, ip net.IP, ttl time.Duration) error {
+	// manageState's periodic scan prunes stale infractions directly, and
+	// goleveldb has no built-in per-key TTL to set one up with.
+	return nil
+}
+
+func (s *levelDBStateStore) Scan(ctx context.Context, fn func(ip net.IP, infractions []time.Time) error) error {
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(levelDBInfractionPrefix)), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		ipStr := strings.TrimPrefix(string(iter.Key()), levelDBInfractionPrefix)
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			ErrorLog("unable to parse ip from %s", ipStr)
+			continue
+		}
+
+		var unixTimes []int64
+		if err := json.Unmarshal(iter.Value(), &unixTimes); err != nil {
+			ErrorLog(err.Error())
+			continue
+		}
+
+		infractions := make([]time.Time, len(unixTimes))
+		for i, t := range unixTimes {
+			infractions[i] = time.Unix(t, 0)
+		}
+
+		if err := fn(ip, infractions); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+func (s *levelDBStateStore) Close() error {
+	return s.db.Close()
+}
+
+// TryAcquire, Refresh and Release make levelDBStateStore its own manageState
+// leader unconditionally: it's a single embedded, on-disk instance, so there
+// are no peers to coordinate with.
+func (s *levelDBStateStore) TryAcquire(ctx context.Context, token string, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (s *levelDBStateStore) Refresh(ctx context.Context, token string, ttl time.Duration) error {
+	return nil
+}
+
+func (s *levelDBStateStore) Release(ctx context.Context, token string) error {
+	return nil
+}
+
+func (s *levelDBStateStore) UpdateTokenBucket(ctx context.Context, ip net.IP, now time.Time, packetCost, maxTokens int64, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := &tokenBucket{}
+	data, err := s.db.Get(bucketStateKey(ip), nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return false, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, bucket); err != nil {
+			return false, err
+		}
+		// Lazily expire: treat a bucket untouched for longer than ttl as gone.
+		if ttl > 0 && now.UnixNano()-bucket.LastTime > ttl.Nanoseconds() {
+			bucket = &tokenBucket{}
+		}
+	}
+
+	allowed := updateTokenBucketLocal(bucket, now, packetCost, maxTokens)
+
+	data, err = json.Marshal(bucket)
+	if err != nil {
+		return false, err
+	}
+	if err := s.db.Put(bucketStateKey(ip), data, nil); err != nil {
+		return false, err
+	}
+
+	return allowed, nil
+}
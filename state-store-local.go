@@ -0,0 +1,37 @@
+package main
+
+import "time"
+
+// tokenBucket is the token-bucket state for a single IP, shared by the
+// single-process StateStore backends (memory and leveldb). It's exported
+// fields so the leveldb backend can serialize it directly.
+type tokenBucket struct {
+	LastTime int64 `json:"t"`
+	Tokens   int64 `json:"n"`
+}
+
+// updateTokenBucketLocal applies the same token-bucket math as the Redis Lua
+// script (see tokenBucketScript), for single-process backends where a mutex
+// is enough to keep the read-modify-write atomic.
+func updateTokenBucketLocal(bucket *tokenBucket, now time.Time, packetCost, maxTokens int64) bool {
+	nowNanos := now.UnixNano()
+	if bucket.LastTime == 0 {
+		bucket.LastTime = nowNanos
+		bucket.Tokens = maxTokens
+	}
+
+	tokens := bucket.Tokens + (nowNanos - bucket.LastTime)
+	if tokens > maxTokens {
+		tokens = maxTokens
+	}
+	tokens -= packetCost
+	bucket.LastTime = nowNanos
+
+	if tokens < 0 {
+		bucket.Tokens = 0
+		return false
+	}
+
+	bucket.Tokens = tokens
+	return true
+}
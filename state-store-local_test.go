@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateTokenBucketLocal(t *testing.T) {
+	const packetCost = int64(time.Second) / 10
+	const maxTokens = packetCost * 20
+
+	start := time.Unix(1000, 0)
+
+	bucket := &tokenBucket{}
+	if allowed := updateTokenBucketLocal(bucket, start, packetCost, maxTokens); !allowed {
+		t.Fatalf("first request on an empty bucket should be allowed")
+	}
+	if bucket.Tokens != maxTokens-packetCost {
+		t.Fatalf("tokens = %d, want %d", bucket.Tokens, maxTokens-packetCost)
+	}
+
+	// Draining the rest of the burst with back-to-back requests and no
+	// elapsed time should eventually exhaust the bucket.
+	for i := 0; i < 19; i++ {
+		updateTokenBucketLocal(bucket, start, packetCost, maxTokens)
+	}
+	if bucket.Tokens != 0 {
+		t.Fatalf("tokens = %d, want 0 once the burst is spent", bucket.Tokens)
+	}
+	if allowed := updateTokenBucketLocal(bucket, start, packetCost, maxTokens); allowed {
+		t.Fatalf("request on an exhausted bucket should not be allowed")
+	}
+	if bucket.Tokens != 0 {
+		t.Fatalf("tokens = %d, want 0 once exhausted", bucket.Tokens)
+	}
+
+	// Letting a full second elapse should refill enough tokens for ten more
+	// requests (half the burst) at this packetCost.
+	later := start.Add(time.Second)
+	if allowed := updateTokenBucketLocal(bucket, later, packetCost, maxTokens); !allowed {
+		t.Fatalf("request after refill should be allowed")
+	}
+
+	// Tokens should never exceed maxTokens even after a long idle period.
+	idle := &tokenBucket{LastTime: start.UnixNano(), Tokens: maxTokens}
+	updateTokenBucketLocal(idle, start.Add(time.Hour), packetCost, maxTokens)
+	if idle.Tokens != maxTokens-packetCost {
+		t.Fatalf("tokens = %d, want %d (capped at maxTokens before spending)", idle.Tokens, maxTokens-packetCost)
+	}
+}
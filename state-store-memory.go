@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// memoryStateStore is an in-process StateStore: no persistence, only useful
+// for a single-node deployment or tests where standing up Redis isn't
+// warranted.
+type memoryStateStore struct {
+	mu          sync.Mutex
+	infractions map[string][]time.Time
+	buckets     map[string]*tokenBucket
+}
+
+func newMemoryStateStore() *memoryStateStore {
+	return &memoryStateStore{
+		infractions: make(map[string][]time.Time),
+		buckets:     make(map[string]*tokenBucket),
+	}
+}
+
+func (s *memoryStateStore) Append(ctx context.Context, ip net.IP, ts time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ip.String()
+	s.infractions[key] = append(s.infractions[key], ts)
+	return int64(len(s.infractions[key])), nil
+}
+
+func (s *memoryStateStore) List(ctx context.Context, ip net.IP) ([]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rv := make([]time.Time, len(s.infractions[ip.String()]))
+	copy(rv, s.infractions[ip.String()])
+	return rv, nil
+}
+
+func (s *memoryStateStore) Trim(ctx context.Context, ip net.IP, from int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ip.String()
+	if from >= int64(len(s.infractions[key])) {
+		delete(s.infractions, key)
+		return nil
+	}
+	s.infractions[key] = s.infractions[key][from:]
+	return nil
+}
+
+func (s *memoryStateStore) Delete(ctx context.Context, ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.infractions, ip.String())
+	return nil
+}
+
+func (s *memoryStateStore) Expire(ctx context.Context, ip net.IP, ttl time.Duration) error {
+	// manageState's periodic scan already prunes infractions once they age
+	// out past FindTime/BanTime, so there's no separate TTL to schedule.
+	return nil
+}
+
+func (s *memoryStateStore) Scan(ctx context.Context, fn func(ip net.IP, infractions []time.Time) error) error {
+	s.mu.Lock()
+	snapshot := make(map[string][]time.Time, len(s.infractions))
+	for k, v := range s.infractions {
+		snapshot[k] = append([]time.Time(nil), v...)
+	}
+	s.mu.Unlock()
+
+	for k, v := range snapshot {
+		ip := net.ParseIP(k)
+		if ip == nil {
+			continue
+		}
+		if err := fn(ip, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStateStore) Close() error {
+	return nil
+}
+
+// TryAcquire, Refresh and Release make memoryStateStore its own manageState
+// leader unconditionally: it's in-process state, so there are no peers to
+// coordinate with.
+func (s *memoryStateStore) TryAcquire(ctx context.Context, token string, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (s *memoryStateStore) Refresh(ctx context.Context, token string, ttl time.Duration) error {
+	return nil
+}
+
+func (s *memoryStateStore) Release(ctx context.Context, token string) error {
+	return nil
+}
+
+func (s *memoryStateStore) UpdateTokenBucket(ctx context.Context, ip net.IP, now time.Time, packetCost, maxTokens int64, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Lazily expire: a bucket untouched for longer than ttl is as good as
+	// gone, same as Redis's EXPIRE on the key.
+	key := ip.String()
+	bucket, ok := s.buckets[key]
+	if ok && ttl > 0 && now.UnixNano()-bucket.LastTime > ttl.Nanoseconds() {
+		delete(s.buckets, key)
+		ok = false
+	}
+	if !ok {
+		bucket = &tokenBucket{}
+		s.buckets[key] = bucket
+	}
+
+	return updateTokenBucketLocal(bucket, now, packetCost, maxTokens), nil
+}
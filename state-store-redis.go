@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const redisInfractionPrefix = "aws-fail2ban-"
+const redisBucketPrefix = "aws-fail2ban-bucket-"
+
+const (
+	redisEventsChannel      = "aws-fail2ban:events"
+	redisSyncRequestChannel = "aws-fail2ban:sync-request"
+	redisSyncReplyPrefix    = "aws-fail2ban:sync-reply:"
+	syncRequestWindow       = 2 * time.Second
+)
+
+const managerLockKey = "aws-fail2ban:manager-lock"
+
+// redisStateStore is the original StateStore backend, a thin wrapper around
+// RedisClient so it works unmodified against a single node, a sentinel group
+// or a cluster. It also implements RateLimiter and EventBus, since both of
+// those need a connection shared across containers.
+type redisStateStore struct {
+	client RedisClient
+	nodeID string
+}
+
+func newRedisStateStore(client RedisClient) *redisStateStore {
+	return &redisStateStore{client: client, nodeID: newNodeID()}
+}
+
+// The key is hash-tag-slotted on the IP (rather than plain aws-fail2ban-<ip>)
+// so that in cluster mode every key for a given IP, present and future, is
+// guaranteed to land on the same slot.
+func redisInfractionKey(ip net.IP) string {
+	return fmt.Sprintf("%s{%s}", redisInfractionPrefix, ip.String())
+}
+
+func redisBucketKey(ip net.IP) string {
+	return fmt.Sprintf("%s{%s}", redisBucketPrefix, ip.String())
+}
+
+func redisKeyToIp(key, prefix string) net.IP {
+	// prefix doesn't include the hash-tag braces added by redisInfractionKey
+	// and redisBucketKey, so strip those off separately.
+	// Possibly nil but should never happen
+	return net.ParseIP(key[len(prefix)+len("{") : len(key)-len("}")])
+}
+
+func parseInfractions(redisList []string) []time.Time {
+	var rv []time.Time
+	for _, s := range redisList {
+		unixtime, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			ErrorLog("unable to parse time %s", s)
+			continue
+		}
+		rv = append(rv, time.Unix(unixtime, 0))
+	}
+	return rv
+}
+
+func (s *redisStateStore) Append(ctx context.Context, ip net.IP, ts time.Time) (int64, error) {
+	return s.client.RPush(ctx, redisInfractionKey(ip), ts.Unix()).Result()
+}
+
+func (s *redisStateStore) List(ctx context.Context, ip net.IP) ([]time.Time, error) {
+	redisList, err := s.client.LRange(ctx, redisInfractionKey(ip), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseInfractions(redisList), nil
+}
+
+func (s *redisStateStore) Trim(ctx context.Context, ip net.IP, from int64) error {
+	_, err := s.client.LTrim(ctx, redisInfractionKey(ip), from, -1).Result()
+	return err
+}
+
+func (s *redisStateStore) Delete(ctx context.Context, ip net.IP) error {
+	_, err := s.client.Del(ctx, redisInfractionKey(ip)).Result()
+	return err
+}
+
+func (s *redisStateStore) Expire(ctx context.Context, ip net.IP, ttl time.Duration) error {
+	_, err := s.client.Expire(ctx, redisInfractionKey(ip), ttl).Result()
+	return err
+}
+
+// Scan mirrors the previous manageState scan loop, but now runs once per
+// cluster master via forEachMaster since a plain SCAN only ever sees the
+// keys held by the node it's issued against.
+func (s *redisStateStore) Scan(ctx context.Context, fn func(ip net.IP, infractions []time.Time) error) error {
+	return forEachMaster(ctx, s.client, func(client RedisClient) error {
+		var cursor uint64 = 0
+		var count int64 = 100
+
+		for {
+			keys, retCursor, err := client.Scan(ctx, cursor, redisInfractionPrefix+"*", count).Result()
+			if err != nil {
+				return err
+			}
+
+			for _, key := range keys {
+				if strings.HasPrefix(key, redisBucketPrefix) {
+					continue
+				}
+
+				ip := redisKeyToIp(key, redisInfractionPrefix)
+				if ip == nil {
+					ErrorLog("unable to parse ip from %s", key)
+					continue
+				}
+
+				redisList, err := client.LRange(ctx, key, 0, -1).Result()
+				if err != nil {
+					return err
+				}
+
+				if err := fn(ip, parseInfractions(redisList)); err != nil {
+					return err
+				}
+			}
+
+			if retCursor == 0 {
+				break
+			}
+			cursor = retCursor
+
+			if count < 1000 {
+				count *= 2
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *redisStateStore) Close() error {
+	return s.client.Close()
+}
+
+// tokenBucketScript atomically applies the token-bucket update to a single
+// IP: KEYS[1] is the bucket's hash key, and ARGV carries the current time,
+// the packet cost and bucket capacity (both in nanoseconds) and the key's GC
+// ttl in seconds. It returns 1 if the request is allowed, 0 otherwise.
+// Running the whole read-modify-write as one EVAL keeps it atomic across
+// containers sharing the same Redis node.
+const tokenBucketScript = `
+local key, now, packetCost, maxTokens, ttl =
+	KEYS[1], tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+
+local lastTime = tonumber(redis.call('HGET', key, 't'))
+local tokens = tonumber(redis.call('HGET', key, 'n'))
+if lastTime == nil then lastTime = now end
+if tokens == nil then tokens = maxTokens end
+
+tokens = math.min(maxTokens, tokens + (now - lastTime))
+tokens = tokens - packetCost
+
+local allowed = 1
+if tokens < 0 then
+	allowed = 0
+	tokens = 0
+end
+
+redis.call('HSET', key, 't', now, 'n', tokens)
+redis.call('EXPIRE', key, ttl)
+
+return allowed
+`
+
+func (s *redisStateStore) UpdateTokenBucket(ctx context.Context, ip net.IP, now time.Time, packetCost, maxTokens int64, ttl time.Duration) (bool, error) {
+	result, err := s.client.Eval(ctx, tokenBucketScript,
+		[]string{redisBucketKey(ip)},
+		now.UnixNano(), packetCost, maxTokens, int64(ttl.Seconds())).Result()
+	if err != nil {
+		return false, err
+	}
+
+	allowed, ok := result.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected token bucket result %v", result)
+	}
+
+	return allowed == 1, nil
+}
+
+// managerLockRefreshScript and managerLockReleaseScript only touch the lock
+// key if it still holds this process's token, so a node whose lease already
+// expired (and was claimed by someone else) can never refresh or delete a
+// peer's lease out from under it.
+const managerLockRefreshScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`
+
+const managerLockReleaseScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+
+// TryAcquire takes out the manager lock with SET NX PX, so only one
+// container at a time believes it's the manageState leader.
+func (s *redisStateStore) TryAcquire(ctx context.Context, token string, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, managerLockKey, token, ttl).Result()
+}
+
+func (s *redisStateStore) Refresh(ctx context.Context, token string, ttl time.Duration) error {
+	_, err := s.client.Eval(ctx, managerLockRefreshScript, []string{managerLockKey}, token, ttl.Milliseconds()).Result()
+	return err
+}
+
+func (s *redisStateStore) Release(ctx context.Context, token string) error {
+	_, err := s.client.Eval(ctx, managerLockReleaseScript, []string{managerLockKey}, token).Result()
+	return err
+}
+
+// PublishBan and PublishUnban announce a ban/unban on the shared events
+// channel so peer containers can apply it to their own ipset without waiting
+// on their next manageState scan.
+func (s *redisStateStore) PublishBan(ctx context.Context, ip net.IP, until time.Time) error {
+	return s.publish(ctx, redisEventsChannel, BanEvent{NodeID: s.nodeID, Op: "ban", IP: ip.String(), Until: until})
+}
+
+func (s *redisStateStore) PublishUnban(ctx context.Context, ip net.IP) error {
+	return s.publish(ctx, redisEventsChannel, BanEvent{NodeID: s.nodeID, Op: "unban", IP: ip.String()})
+}
+
+func (s *redisStateStore) publish(ctx context.Context, channel string, ev BanEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Publish(ctx, channel, data).Result()
+	return err
+}
+
+// Subscribe listens on the shared events channel for peer-originated
+// ban/unban events, and on the sync-request channel for peers bootstrapping
+// their ban list, until ctx is canceled.
+func (s *redisStateStore) Subscribe(ctx context.Context, onBan func(ip net.IP, until time.Time), onUnban func(ip net.IP), currentlyBanned func() []net.IP) error {
+	pubsub := s.client.Subscribe(ctx, redisEventsChannel, redisSyncRequestChannel)
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+
+			switch msg.Channel {
+			case redisEventsChannel:
+				s.handleEvent(msg.Payload, onBan, onUnban)
+			case redisSyncRequestChannel:
+				s.handleSyncRequest(ctx, msg.Payload, currentlyBanned)
+			}
+		}
+	}
+}
+
+func (s *redisStateStore) handleEvent(payload string, onBan func(ip net.IP, until time.Time), onUnban func(ip net.IP)) {
+	var ev BanEvent
+	if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+		ErrorLog(err.Error())
+		return
+	}
+	if ev.NodeID == s.nodeID {
+		return
+	}
+
+	ip := net.ParseIP(ev.IP)
+	if ip == nil {
+		ErrorLog("unable to parse ip from %s", ev.IP)
+		return
+	}
+
+	switch ev.Op {
+	case "ban":
+		onBan(ip, ev.Until)
+	case "unban":
+		onUnban(ip)
+	}
+}
+
+func (s *redisStateStore) handleSyncRequest(ctx context.Context, payload string, currentlyBanned func() []net.IP) {
+	var ev BanEvent
+	if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+		ErrorLog(err.Error())
+		return
+	}
+	if ev.NodeID == s.nodeID {
+		return
+	}
+
+	replyChannel := redisSyncReplyPrefix + ev.NodeID
+	for _, ip := range currentlyBanned() {
+		if err := s.publish(ctx, replyChannel, BanEvent{NodeID: s.nodeID, Op: "ban", IP: ip.String()}); err != nil {
+			ErrorLog(err.Error())
+		}
+	}
+}
+
+// RequestSync broadcasts a sync-request and collects replies on this node's
+// private reply channel for a short window, delivering each banned IP a peer
+// reports to onBan. Used once at startup so a newly started container
+// doesn't have to wait for its own manageState scan to learn about bans
+// already in effect elsewhere in the fleet.
+func (s *redisStateStore) RequestSync(ctx context.Context, onBan func(ip net.IP, until time.Time)) error {
+	pubsub := s.client.Subscribe(ctx, redisSyncReplyPrefix+s.nodeID)
+	defer pubsub.Close()
+
+	if err := s.publish(ctx, redisSyncRequestChannel, BanEvent{NodeID: s.nodeID, Op: "sync-request"}); err != nil {
+		return err
+	}
+
+	timeout := time.After(syncRequestWindow)
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-timeout:
+			return nil
+
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+
+			var ev BanEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+				ErrorLog(err.Error())
+				continue
+			}
+
+			ip := net.ParseIP(ev.IP)
+			if ip == nil {
+				ErrorLog("unable to parse ip from %s", ev.IP)
+				continue
+			}
+
+			onBan(ip, ev.Until)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRedisKeyRoundTrip(t *testing.T) {
+	for _, s := range []string{"1.2.3.4", "::1", "2001:db8::1"} {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			t.Fatalf("net.ParseIP(%q) returned nil", s)
+		}
+
+		infractionKey := redisInfractionKey(ip)
+		if got := redisKeyToIp(infractionKey, redisInfractionPrefix); got == nil || !got.Equal(ip) {
+			t.Errorf("redisKeyToIp(%q) = %v, want %v", infractionKey, got, ip)
+		}
+
+		bucketKey := redisBucketKey(ip)
+		if got := redisKeyToIp(bucketKey, redisBucketPrefix); got == nil || !got.Equal(ip) {
+			t.Errorf("redisKeyToIp(%q) = %v, want %v", bucketKey, got, ip)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// StateStore abstracts the per-IP infraction bookkeeping ServiceJailer needs,
+// so Redis isn't the only viable backend.
+type StateStore interface {
+	// Append records a new infraction for ip at ts and returns the number of
+	// infractions currently stored for it.
+	Append(ctx context.Context, ip net.IP, ts time.Time) (count int64, err error)
+
+	// List returns every recorded infraction time for ip, oldest first.
+	List(ctx context.Context, ip net.IP) ([]time.Time, error)
+
+	// Trim drops every infraction for ip before index from.
+	Trim(ctx context.Context, ip net.IP, from int64) error
+
+	// Delete removes all state for ip.
+	Delete(ctx context.Context, ip net.IP) error
+
+	// Expire arranges for ip's state to be garbage collected after ttl. The
+	// memory and leveldb backends don't implement it (it's a no-op there) and
+	// rely on manageState's scan to prune old infractions instead.
+	Expire(ctx context.Context, ip net.IP, ttl time.Duration) error
+
+	// Scan invokes fn once per IP currently tracked, passing its recorded
+	// infractions. Backends that shard across multiple nodes (e.g. a Redis
+	// Cluster) may call fn concurrently from multiple goroutines; callers
+	// that accumulate state across calls must synchronize it themselves.
+	Scan(ctx context.Context, fn func(ip net.IP, infractions []time.Time) error) error
+
+	// Close releases the backend's resources. It doesn't take a context, and
+	// some backends (e.g. leveldb flushing to disk) can block in it;
+	// ServiceJailer.Close bounds the wait with its own ctx.
+	Close() error
+}
+
+// RateLimiter is implemented by StateStore backends that can atomically
+// apply a token-bucket update; used by ServiceJailer.AddRequest. Every
+// built-in backend implements it, but it's kept separate from StateStore
+// since rate limiting is an alternative to, not part of, the core
+// infraction bookkeeping.
+type RateLimiter interface {
+	UpdateTokenBucket(ctx context.Context, ip net.IP, now time.Time, packetCost, maxTokens int64, ttl time.Duration) (allowed bool, err error)
+}
+
+// NewStateStore dispatches on conn's scheme to build a StateStore:
+//
+//	redis://host:port
+//	redis+sentinel://sentinel1:26379,sentinel2:26379/masterName
+//	redis+cluster://host1:7000,host2:7000
+//	memory://
+//	leveldb:///var/lib/aws-fail2ban
+func NewStateStore(conn string) (StateStore, error) {
+	u, err := url.Parse(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "redis":
+		client, err := newSingleRedisClient(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return newRedisStateStore(client), nil
+
+	case "redis+sentinel":
+		masterName := strings.TrimPrefix(u.Path, "/")
+		client, err := newSentinelRedisClient(masterName, strings.Split(u.Host, ","))
+		if err != nil {
+			return nil, err
+		}
+		return newRedisStateStore(client), nil
+
+	case "redis+cluster":
+		client, err := newClusterRedisClient(strings.Split(u.Host, ","))
+		if err != nil {
+			return nil, err
+		}
+		return newRedisStateStore(client), nil
+
+	case "memory":
+		return newMemoryStateStore(), nil
+
+	case "leveldb":
+		return newLevelDBStateStore(u.Path)
+
+	default:
+		return nil, fmt.Errorf("unsupported state store scheme %q", u.Scheme)
+	}
+}
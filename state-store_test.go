@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestStateStoreConformance runs the same scenario against every StateStore
+// backend, so a regression in one of them (e.g. a backend-specific key
+// encoding bug) can't hide behind the others passing.
+func TestStateStoreConformance(t *testing.T) {
+	backends := []struct {
+		name string
+		new  func(t *testing.T) StateStore
+	}{
+		{"memory", func(t *testing.T) StateStore {
+			return newMemoryStateStore()
+		}},
+		{"leveldb", func(t *testing.T) StateStore {
+			store, err := newLevelDBStateStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		}},
+	}
+
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		backends = append(backends, struct {
+			name string
+			new  func(t *testing.T) StateStore
+		}{"redis", func(t *testing.T) StateStore {
+			client, err := newSingleRedisClient(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return newRedisStateStore(client)
+		}})
+	}
+
+	for _, b := range backends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			store := b.new(t)
+			t.Cleanup(func() {
+				if err := store.Close(); err != nil {
+					t.Errorf("Close: %v", err)
+				}
+			})
+			testStateStoreConformance(t, store)
+		})
+	}
+}
+
+func testStateStoreConformance(t *testing.T, store StateStore) {
+	ctx := context.Background()
+	ip := net.ParseIP("203.0.113.7")
+
+	if infractions, err := store.List(ctx, ip); err != nil {
+		t.Fatalf("List on a fresh ip: %v", err)
+	} else if len(infractions) != 0 {
+		t.Fatalf("List on a fresh ip = %v, want none", infractions)
+	}
+
+	times := []time.Time{time.Unix(1000, 0), time.Unix(2000, 0), time.Unix(3000, 0)}
+	for i, ts := range times {
+		count, err := store.Append(ctx, ip, ts)
+		if err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		if count != int64(i+1) {
+			t.Fatalf("Append count = %d, want %d", count, i+1)
+		}
+	}
+
+	infractions, err := store.List(ctx, ip)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(infractions) != len(times) {
+		t.Fatalf("List = %v, want %v", infractions, times)
+	}
+	for i, want := range times {
+		if !infractions[i].Equal(want) {
+			t.Fatalf("List[%d] = %v, want %v", i, infractions[i], want)
+		}
+	}
+
+	if err := store.Trim(ctx, ip, 1); err != nil {
+		t.Fatalf("Trim: %v", err)
+	}
+	if infractions, err := store.List(ctx, ip); err != nil {
+		t.Fatalf("List after Trim: %v", err)
+	} else if len(infractions) != 2 || !infractions[0].Equal(times[1]) {
+		t.Fatalf("List after Trim = %v, want %v", infractions, times[1:])
+	}
+
+	if err := store.Expire(ctx, ip, time.Hour); err != nil {
+		t.Fatalf("Expire: %v", err)
+	}
+
+	found := false
+	if err := store.Scan(ctx, func(scanIP net.IP, _ []time.Time) error {
+		if scanIP.Equal(ip) {
+			found = true
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if !found {
+		t.Fatalf("Scan never visited %s", ip)
+	}
+
+	if err := store.Delete(ctx, ip); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if infractions, err := store.List(ctx, ip); err != nil {
+		t.Fatalf("List after Delete: %v", err)
+	} else if len(infractions) != 0 {
+		t.Fatalf("List after Delete = %v, want none", infractions)
+	}
+
+	if limiter, ok := store.(RateLimiter); ok {
+		allowed, err := limiter.UpdateTokenBucket(ctx, ip, time.Now(), 1, 10, time.Minute)
+		if err != nil {
+			t.Fatalf("UpdateTokenBucket: %v", err)
+		}
+		if !allowed {
+			t.Fatalf("first UpdateTokenBucket request should be allowed")
+		}
+	}
+
+	if locker, ok := store.(ManagerLock); ok {
+		const token = "conformance-token"
+		acquired, err := locker.TryAcquire(ctx, token, time.Minute)
+		if err != nil {
+			t.Fatalf("TryAcquire: %v", err)
+		}
+		if !acquired {
+			t.Fatalf("TryAcquire should succeed when nothing else holds the lock")
+		}
+		if err := locker.Refresh(ctx, token, time.Minute); err != nil {
+			t.Fatalf("Refresh: %v", err)
+		}
+		if err := locker.Release(ctx, token); err != nil {
+			t.Fatalf("Release: %v", err)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Defaults for the token-bucket rate limiter, overridable per jailer via
+// SetRateLimit.
+const (
+	defaultPacketsPerSecond = 10
+	defaultPacketsBurstable = 20
+	defaultTokenBucketTTL   = time.Hour
+)
+
+// SetRateLimit configures the token-bucket parameters used by AddRequest.
+func (j *ServiceJailer) SetRateLimit(packetsPerSecond, packetsBurstable int64, gcTTL time.Duration) {
+	j.packetsPerSecond = packetsPerSecond
+	j.packetsBurstable = packetsBurstable
+	j.tokenBucketTTL = gcTTL
+}
+
+// AddRequest applies a token-bucket rate limit to ip and reports whether the
+// request is allowed, as an alternative to AddInfraction's MaxRetry/FindTime
+// model.
+func (j ServiceJailer) AddRequest(ctx context.Context, ip net.IP) (bool, error) {
+	limiter, ok := j.store.(RateLimiter)
+	if !ok {
+		return false, fmt.Errorf("state store does not support rate limiting")
+	}
+
+	packetCost := int64(time.Second) / j.packetsPerSecond
+	maxTokens := packetCost * j.packetsBurstable
+
+	return limiter.UpdateTokenBucket(ctx, ip, time.Now(), packetCost, maxTokens, j.tokenBucketTTL)
+}